@@ -0,0 +1,174 @@
+package sudph
+
+import (
+	"context"
+	"net"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/xlog"
+)
+
+// CandidateType ranks an ICE-lite candidate by how likely it is to succeed,
+// mirroring the usual host > server-reflexive > relay ordering.
+type CandidateType int
+
+const (
+	// CandidateHost is a locally bound address, valid when both peers share
+	// a network or one sits behind a simple NAT that the other can reach directly.
+	CandidateHost CandidateType = iota
+	// CandidateServerReflexive is the address the address resolver observed
+	// for us, i.e. our NAT mapping as seen from outside (a STUN-style binding).
+	CandidateServerReflexive
+	// CandidatePredicted is a guessed address derived from a symmetric NAT's
+	// observed port-allocation delta, tried alongside the confirmed
+	// server-reflexive address rather than instead of it.
+	CandidatePredicted
+	// CandidateRelay is a DMSG-relayed address, used as a last resort when
+	// both peers sit behind symmetric NATs and direct hole-punching won't
+	// work. Nothing in this tree ever constructs one: relay-candidate
+	// gathering was removed as unreachable, so this type exists for the
+	// priority ordering below and for a future gatherer to target, not
+	// because any candidate set produced today can contain one.
+	CandidateRelay
+)
+
+// priority orders candidate types for pair selection: host wins over
+// server-reflexive, which wins over a predicted port, which wins over relay.
+func (t CandidateType) priority() int {
+	switch t {
+	case CandidateHost:
+		return 3
+	case CandidateServerReflexive:
+		return 2
+	case CandidatePredicted:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// String implements fmt.Stringer.
+func (t CandidateType) String() string {
+	switch t {
+	case CandidateHost:
+		return "host"
+	case CandidateServerReflexive:
+		return "srflx"
+	case CandidatePredicted:
+		return "predicted"
+	case CandidateRelay:
+		return "relay"
+	default:
+		return "unknown"
+	}
+}
+
+// Candidate is a single address a peer might be reachable at.
+type Candidate struct {
+	Type CandidateType
+	Addr string // host:port
+}
+
+// reflexiveResolver reports our server-reflexive address, i.e. the address
+// observed while we were dialing out, the way a STUN server reports a
+// binding response. See the Option doc comment for why this is supplied via
+// WithReflexiveResolver instead of being asserted against addressResolver.
+type reflexiveResolver interface {
+	ReflexiveUDPAddr() string
+}
+
+// WithReflexiveResolver supplies where gatherReflexiveCandidate asks for our
+// server-reflexive address. Serve only logs that address; Dial's candidate
+// set is built from the peer's resolved data and does not use it. Without
+// it, Serve has nothing to log.
+func WithReflexiveResolver(r reflexiveResolver) Option {
+	return func(c *Client) {
+		c.reflexiveResolver = r
+	}
+}
+
+// gatherReflexiveCandidate asks the configured reflexive resolver for our
+// server-reflexive address, when one is configured. It returns ok=false
+// otherwise. Serve logs the result once BindSUDPH succeeds, so operators
+// diagnosing a NAT-traversal failure can see what external address we think
+// we have.
+func (c *Client) gatherReflexiveCandidate() (Candidate, bool) {
+	if c.reflexiveResolver == nil {
+		return Candidate{}, false
+	}
+
+	addr := c.reflexiveResolver.ReflexiveUDPAddr()
+	if addr == "" {
+		return Candidate{}, false
+	}
+
+	return Candidate{Type: CandidateServerReflexive, Addr: addr}, true
+}
+
+// checkResult is the outcome of a single connectivity check against one candidate pair.
+type checkResult struct {
+	candidate Candidate
+	conn      net.Conn
+	err       error
+}
+
+// dialCandidates runs a connectivity check against every remote candidate in
+// parallel and returns the connection for the highest-priority candidate
+// that succeeded (host > srflx > relay), closing any other successful
+// connections along the way.
+func (c *Client) dialCandidates(ctx context.Context, rPK cipher.PubKey, candidates []Candidate) (net.Conn, error) {
+	if len(candidates) == 0 {
+		return nil, ErrTimeout
+	}
+
+	log := xlog.FromContext(ctx, c.log)
+
+	resultCh := make(chan checkResult, len(candidates))
+
+	for _, cand := range candidates {
+		cand := cand
+
+		go func() {
+			conn, err := c.dialUDP(ctx, rPK, cand.Addr)
+			resultCh <- checkResult{candidate: cand, conn: conn, err: err}
+		}()
+	}
+
+	var best *checkResult
+
+	for i := 0; i < len(candidates); i++ {
+		res := <-resultCh
+
+		if res.err != nil {
+			log.WithError(res.err).
+				WithField("candidate_type", res.candidate.Type).
+				WithField("candidate_addr", res.candidate.Addr).
+				Infof("Connectivity check failed for candidate")
+			continue
+		}
+
+		switch {
+		case best == nil:
+			res := res
+			best = &res
+		case res.candidate.Type.priority() > best.candidate.Type.priority():
+			_ = best.conn.Close()
+			res := res
+			best = &res
+		default:
+			_ = res.conn.Close()
+		}
+	}
+
+	if best == nil {
+		return nil, ErrTimeout
+	}
+
+	log.
+		WithField("candidate_type", best.candidate.Type).
+		WithField("candidate_addr", best.candidate.Addr).
+		Infof("Selected candidate after parallel connectivity checks")
+
+	return best.conn, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AudriusButkevicius/pfilter"
@@ -14,11 +15,13 @@ import (
 	"github.com/SkycoinProject/dmsg/cipher"
 	"github.com/SkycoinProject/skycoin/src/util/logging"
 	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
 
 	"github.com/SkycoinProject/skywire-mainnet/internal/packetfilter"
 	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/arclient"
 	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/directtransport"
 	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/directtransport/porter"
+	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/xlog"
 )
 
 // Type is sudp hole punch type.
@@ -33,14 +36,31 @@ const HolePunchMessage = "holepunch"
 // ErrTimeout indicates a timeout.
 var ErrTimeout = errors.New("timeout")
 
+// connCounter generates conv_id values so a connection's lifecycle can be
+// correlated across log lines.
+var connCounter uint64
+
+func nextConvID() string {
+	return fmt.Sprintf("conv-%d", atomic.AddUint64(&connCounter, 1))
+}
+
 // Client is the central control for incoming and outgoing 'sudp.Conn's.
 type Client struct {
 	log *logging.Logger
 
-	lPK             cipher.PubKey
-	lSK             cipher.SecKey
-	p               *porter.Porter
-	addressResolver arclient.APIClient
+	lPK               cipher.PubKey
+	lSK               cipher.SecKey
+	p                 *porter.Porter
+	addressResolver   arclient.APIClient
+	dtlsMode          DTLSMode
+	holePunchStrategy HolePunchStrategy
+	poolConf          PoolConfig
+	pool              *dialPool
+
+	reflexiveResolver  reflexiveResolver
+	probeResolver      portProbeResolver
+	predictionReporter portPredictionReporter
+	predictionHints    portPredictionHintProvider
 
 	localUDPAddr        string
 	listenerConn        net.PacketConn
@@ -52,12 +72,51 @@ type Client struct {
 	lMap map[uint16]*directtransport.Listener // key: lPort
 	mx   sync.Mutex
 
+	// dtlsListener demultiplexes per-peer DTLSModeUnderKCP association state
+	// over visorConn. Only set when dtlsMode is DTLSModeUnderKCP.
+	dtlsListener *dtlsListenerConn
+
 	done chan struct{}
 	once sync.Once
 }
 
+// Option configures optional behavior on a Client at construction time.
+//
+// Several options below (WithReflexiveResolver, WithPortProbeResolver,
+// WithPortPredictionReporter, WithPortPredictionHintProvider) supply hooks
+// for capabilities the address resolver protocol in use here has no
+// endpoint for (binding responses, port probes, prediction hints). They
+// aren't asserted against addressResolver for that reason - there's nothing
+// there to satisfy the assertion - and are instead supplied explicitly by a
+// caller that has wired up something that does implement them.
+type Option func(*Client)
+
+// WithDTLSMode sets the DTLS wrapping mode used for new connections.
+// The default is DTLSModeDisabled, which keeps the legacy Encrypt:true layer.
+func WithDTLSMode(mode DTLSMode) Option {
+	return func(c *Client) {
+		c.dtlsMode = mode
+	}
+}
+
+// WithHolePunchStrategy sets the hole-punching strategy Client uses in
+// addition to its default candidate set. The default is HolePunchStrategyDefault.
+func WithHolePunchStrategy(strategy HolePunchStrategy) Option {
+	return func(c *Client) {
+		c.holePunchStrategy = strategy
+	}
+}
+
+// WithPoolConfig tunes the connection pool Client uses for repeated Dials to
+// the same peer. The default is DefaultPoolConfig.
+func WithPoolConfig(conf PoolConfig) Option {
+	return func(c *Client) {
+		c.poolConf = conf
+	}
+}
+
 // NewClient creates a net Client.
-func NewClient(pk cipher.PubKey, sk cipher.SecKey, addressResolver arclient.APIClient) *Client {
+func NewClient(pk cipher.PubKey, sk cipher.SecKey, addressResolver arclient.APIClient, opts ...Option) *Client {
 	c := &Client{
 		log:             logging.MustGetLogger(Type),
 		lPK:             pk,
@@ -66,25 +125,39 @@ func NewClient(pk cipher.PubKey, sk cipher.SecKey, addressResolver arclient.APIC
 		p:               porter.New(porter.PorterMinEphemeral),
 		lMap:            make(map[uint16]*directtransport.Listener),
 		done:            make(chan struct{}),
+		poolConf:        DefaultPoolConfig,
 	}
 
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.pool = newDialPool(c.poolConf)
+
 	return c
 }
 
+// Stats returns current connection-pool usage.
+func (c *Client) Stats() PoolStats {
+	return c.pool.stats()
+}
+
 // SetLogger sets a logger for Client.
 func (c *Client) SetLogger(log *logging.Logger) {
 	c.log = log
 }
 
 // Serve serves the listening portion of the client.
-func (c *Client) Serve() error {
+func (c *Client) Serve(ctx context.Context) error {
 	if c.listenerConn != nil {
 		return errors.New("already listening")
 	}
 
-	c.log.Infof("Serving SUDPH client")
+	log := xlog.FromContext(ctx, c.log).With(map[string]interface{}{"handshake_stage": "bind"})
+	ctx = xlog.NewContext(ctx, log)
+
+	log.Infof("Serving SUDPH client")
 
-	ctx := context.Background()
 	network := "udp"
 
 	lAddr, err := net.ResolveUDPAddr(network, "")
@@ -94,14 +167,15 @@ func (c *Client) Serve() error {
 
 	c.localUDPAddr = lAddr.String() // TODO(nkryuchkov): remove?
 
-	c.log.Infof("SUDPH: Resolved local addr from %v to %v", "", lAddr)
+	log.With(map[string]interface{}{"resolved_addr": lAddr.String()}).Infof("SUDPH: Resolved local addr")
 
 	rAddr, err := net.ResolveUDPAddr(network, c.addressResolver.RemoteUDPAddr())
 	if err != nil {
 		return err
 	}
 
-	c.log.Infof("SUDPH dialing udp from %v to %v", lAddr, rAddr)
+	log.With(map[string]interface{}{"local_addr": lAddr.String(), "remote_addr": rAddr.String()}).
+		Infof("SUDPH dialing udp")
 
 	listenerConn, err := net.ListenUDP(network, lAddr)
 	if err != nil {
@@ -121,14 +195,20 @@ func (c *Client) Serve() error {
 		return err
 	}
 
-	c.log.Infof("SUDPH Local port: %v", localPort)
+	log = log.With(map[string]interface{}{"local_port": localPort})
+	ctx = xlog.NewContext(ctx, log)
+
+	log.Infof("SUDPH local port bound")
 
 	arKCPConn, err := kcp.NewConn(c.addressResolver.RemoteUDPAddr(), nil, 0, 0, c.addressResolverConn)
 	if err != nil {
 		return err
 	}
 
-	c.log.Infof("SUDPH updating local UDP addr from %v to %v", c.localUDPAddr, arKCPConn.LocalAddr().String())
+	log.With(map[string]interface{}{
+		"old_local_udp_addr": c.localUDPAddr,
+		"new_local_udp_addr": arKCPConn.LocalAddr().String(),
+	}).Infof("SUDPH updating local UDP addr")
 
 	// TODO(nkryuchkov): consider moving some parts to address-resolver client
 	emptyAddr := dmsg.Addr{PK: cipher.PubKey{}, Port: 0}
@@ -150,48 +230,80 @@ func (c *Client) Serve() error {
 		return fmt.Errorf("newConn: %w", err)
 	}
 
+	// TODO: once arclient.APIClient.BindSUDPH accepts a candidate list instead
+	// of just a port, report our host candidates alongside localPort so
+	// dialing peers get the full ICE-lite candidate set up front.
 	addrCh, err := c.addressResolver.BindSUDPH(ctx, arConn, localPort)
 	if err != nil {
 		return err
 	}
 
+	if refl, ok := c.gatherReflexiveCandidate(); ok {
+		log.With(map[string]interface{}{"reflexive_addr": refl.Addr}).Infof("Our server-reflexive candidate")
+	}
+
+	if c.holePunchStrategy == HolePunchStrategyPortPrediction {
+		if delta, lastPort, ok := c.probeSymmetricNATPorts(ctx); ok {
+			log.With(map[string]interface{}{"port_delta": delta, "last_port": lastPort}).
+				Infof("Measured symmetric NAT port delta")
+
+			if c.predictionReporter != nil {
+				c.predictionReporter.ReportPortPrediction(delta, lastPort)
+			}
+		}
+	}
+
 	go func() {
 		for addr := range addrCh {
 			udpAddr, err := net.ResolveUDPAddr("udp", addr.Addr)
 			if err != nil {
-				c.log.WithError(err).Errorf("Failed to resolve UDP address %q", addr)
+				log.WithError(err).WithField("hole_punch_addr", addr.Addr).Errorf("Failed to resolve UDP address")
 				continue
 			}
 
+			punchLog := log.With(map[string]interface{}{"hole_punch_addr": addr.Addr})
+
 			// TODO(nkryuchkov): More robust solution
-			c.log.Infof("Sending hole punch packet to %v", addr)
+			punchLog.Infof("Sending hole punch packet")
 			if _, err := c.visorConn.WriteTo([]byte(HolePunchMessage), udpAddr); err != nil {
-				c.log.WithError(err).Errorf("Failed to send hole punch packet to %v", udpAddr)
+				punchLog.WithError(err).Errorf("Failed to send hole punch packet")
 				continue
 			}
 
-			c.log.Infof("Sent hole punch packet to %v", addr)
+			punchLog.Infof("Sent hole punch packet")
 		}
 	}()
 
-	lUDP, err := kcp.ServeConn(nil, 0, 0, c.visorConn)
+	// kcpConn is what kcp.ServeConn reads and writes. visorConn itself must
+	// stay usable unwrapped above for the raw hole-punch probe writes; when
+	// DTLSModeUnderKCP is active, a separate dtlsListenerConn demultiplexes
+	// each peer's association over the same underlying socket instead, so
+	// KCP's reliability layer runs on top of an already-encrypted flow.
+	var kcpConn net.PacketConn = c.visorConn
+
+	if c.dtlsMode == DTLSModeUnderKCP {
+		c.dtlsListener = wrapListenerPacketConn(c.visorConn, c.lSK, c.lPK)
+		kcpConn = c.dtlsListener
+	}
+
+	lUDP, err := kcp.ServeConn(nil, 0, 0, kcpConn)
 	if err != nil {
 		return err
 	}
 
 	c.lUDP = lUDP
 	addr := lUDP.Addr()
-	c.log.Infof("listening on udp addr: %v", addr)
+	log.With(map[string]interface{}{"listen_addr": addr.String()}).Infof("listening on udp")
 
-	c.log.Infof("bound BindSUDPH to %v", c.addressResolver.LocalTCPAddr())
+	log.With(map[string]interface{}{"bind_addr": c.addressResolver.LocalTCPAddr()}).Infof("bound BindSUDPH")
 
 	go func() {
 		for {
-			if err := c.acceptUDPConn(); err != nil {
-				c.log.Warnf("failed to accept incoming connection: %v", err)
+			if err := c.acceptUDPConn(ctx); err != nil {
+				log.WithError(err).Warnf("failed to accept incoming connection")
 
 				if !directtransport.IsHandshakeError(err) {
-					c.log.Warnf("stopped serving sudpr")
+					log.Warnf("stopped serving sudpr")
 					return
 				}
 			}
@@ -201,45 +313,85 @@ func (c *Client) Serve() error {
 	return nil
 }
 
-func (c *Client) dialVisor(visorData arclient.VisorData) (net.Conn, error) {
+// remoteCandidates builds the ICE-lite candidate list for a resolved peer:
+// their host addresses when we're on the same network, the server-reflexive
+// address the address resolver resolved for them, and, when
+// HolePunchStrategyPortPrediction is enabled, a window of predicted ports
+// around their last observed symmetric-NAT mapping.
+//
+// The predicted-port window depends on predictedCandidates' call to
+// c.predictionHints, which is only populated via WithPortPredictionHintProvider:
+// nothing in this tree implements that interface yet, so enabling
+// HolePunchStrategyPortPrediction alone sprays no predicted ports and adds
+// no candidates beyond whatever visorData itself already carries. It is
+// scaffolding for a resolver that grows those endpoints, not a working
+// NAT/hairpinning improvement by itself.
+func (c *Client) remoteCandidates(rPK cipher.PubKey, visorData arclient.VisorData) []Candidate {
+	var candidates []Candidate
+
 	if visorData.IsLocal {
 		for _, host := range visorData.Addresses {
-			addr := net.JoinHostPort(host, visorData.Port)
-			conn, err := c.dialTimeout(addr)
-			if err == nil {
-				return conn, nil
-			}
+			candidates = append(candidates, Candidate{
+				Type: CandidateHost,
+				Addr: net.JoinHostPort(host, visorData.Port),
+			})
 		}
 	}
 
-	return c.dialTimeout(visorData.RemoteAddr)
+	if visorData.RemoteAddr != "" {
+		candidates = append(candidates, Candidate{
+			Type: CandidateServerReflexive,
+			Addr: visorData.RemoteAddr,
+		})
+
+		candidates = append(candidates, c.predictedCandidates(rPK, visorData.RemoteAddr)...)
+	}
+
+	return candidates
+}
+
+func (c *Client) dialVisor(ctx context.Context, rPK cipher.PubKey, visorData arclient.VisorData) (net.Conn, error) {
+	return c.dialTimeout(ctx, rPK, c.remoteCandidates(rPK, visorData))
 }
 
-func (c *Client) dialTimeout(addr string) (net.Conn, error) {
+// dialTimeout runs connectivity checks against every candidate in candidates
+// in parallel, retrying the whole candidate set until one pair succeeds or
+// DialTimeout elapses.
+func (c *Client) dialTimeout(ctx context.Context, rPK cipher.PubKey, candidates []Candidate) (net.Conn, error) {
+	log := xlog.FromContext(ctx, c.log).With(map[string]interface{}{"handshake_stage": "hole-punch"})
+
 	timer := time.NewTimer(DialTimeout)
 	defer timer.Stop()
 
-	c.log.Infof("Dialing %v from %v via udp", addr, c.addressResolver.LocalTCPAddr())
+	log.With(map[string]interface{}{
+		"candidate_count": len(candidates),
+		"bind_addr":       c.addressResolver.LocalTCPAddr(),
+	}).Infof("Dialing candidates via udp")
 
 	for {
 		select {
 		case <-timer.C:
 			return nil, ErrTimeout
 		default:
-			conn, err := c.dialUDP(addr)
+			conn, err := c.dialCandidates(ctx, rPK, candidates)
 			if err == nil {
-				c.log.Infof("Dialed %v from %v", addr, c.addressResolver.LocalTCPAddr())
+				log.With(map[string]interface{}{"remote_addr": conn.RemoteAddr().String()}).
+					Infof("Dialed candidate")
 				return conn, nil
 			}
 
-			c.log.WithError(err).
-				Warnf("Failed to dial %v from %v, trying again: %v", addr, c.addressResolver.LocalTCPAddr(), err)
+			log.WithError(err).
+				With(map[string]interface{}{"bind_addr": c.addressResolver.LocalTCPAddr()}).
+				Warnf("Failed all candidate checks, trying again")
 		}
 	}
 }
 
-func (c *Client) dialUDP(remoteAddr string) (net.Conn, error) {
-	c.log.Infof("SUDPH c.localUDPAddr: %q", c.localUDPAddr)
+func (c *Client) dialUDP(ctx context.Context, rPK cipher.PubKey, remoteAddr string) (net.Conn, error) {
+	log := xlog.FromContext(ctx, c.log).With(map[string]interface{}{
+		"remote_addr":    remoteAddr,
+		"local_udp_addr": c.localUDPAddr,
+	})
 
 	// TODO(nkryuchkov): Dial using listener conn?
 	lAddr, err := net.ResolveUDPAddr("udp", c.localUDPAddr)
@@ -252,7 +404,8 @@ func (c *Client) dialUDP(remoteAddr string) (net.Conn, error) {
 		return nil, fmt.Errorf("net.ResolveUDPAddr (remote): %w", err)
 	}
 
-	c.log.Infof("SUDPH: Resolved local addr from %v to %v", c.localUDPAddr, lAddr)
+	log = log.With(map[string]interface{}{"resolved_local_addr": lAddr.String(), "local_port": lAddr.Port})
+	log.Infof("Resolved local addr")
 
 	dialConn := c.packetFilter.NewConn(20, packetfilter.NewKCPConversationFilter())
 
@@ -261,15 +414,23 @@ func (c *Client) dialUDP(remoteAddr string) (net.Conn, error) {
 		return nil, fmt.Errorf("dialConn.WriteTo: %w", err)
 	}
 
-	kcpConn, err := kcp.NewConn(remoteAddr, nil, 0, 0, dialConn)
+	// DTLSModeUnderKCP encrypts below KCP, so the wrap has to happen on the
+	// raw packet conn before kcp.NewConn ever touches it.
+	packetConn, err := c.wrapDialPacketConn(dialConn, rAddr, rPK)
 	if err != nil {
 		return nil, err
 	}
 
-	return kcpConn, nil
+	kcpConn, err := kcp.NewConn(remoteAddr, nil, 0, 0, packetConn)
+	if err != nil {
+		return nil, err
+	}
+
+	// DTLSModeOverKCP encrypts above KCP, once the stream is already reliable.
+	return c.wrapInitiatorConn(kcpConn, rPK)
 }
 
-func (c *Client) acceptUDPConn() error {
+func (c *Client) acceptUDPConn(ctx context.Context) error {
 	if c.isClosed() {
 		return io.ErrClosedPipe
 	}
@@ -279,9 +440,67 @@ func (c *Client) acceptUDPConn() error {
 		return err
 	}
 
-	remoteAddr := udpConn.RemoteAddr()
+	log := xlog.FromContext(ctx, c.log).With(map[string]interface{}{
+		"remote_addr":     udpConn.RemoteAddr().String(),
+		"handshake_stage": "accept",
+	})
+
+	log.Infof("Accepted connection")
+
+	// DTLSModeOverKCP wraps the connection here, before smux or
+	// directtransport's own handshake runs, and resolves the peer's
+	// identity as a side effect of that handshake succeeding.
+	wrappedConn, peerPK, err := c.wrapResponderConn(udpConn)
+	if err != nil {
+		return fmt.Errorf("dtls: %w", err)
+	}
+
+	if c.dtlsMode == DTLSModeOverKCP {
+		log = log.With(map[string]interface{}{"remote_pk": peerPK.String()})
+	}
+
+	// The dialer multiplexes every Dial() to us over one smux session per
+	// pooled, hole-punched conn (see dialPool/openStream): match that here
+	// with the responder side of the same session, instead of handing
+	// smux-framed bytes straight to directtransport, which can't parse them.
+	session, err := smux.Server(wrappedConn, smux.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("smux.Server: %w", err)
+	}
+
+	go c.serveSmuxSession(log, session)
+
+	return nil
+}
+
+// serveSmuxSession accepts streams from session until it errors or closes,
+// handing each stream through its own directtransport responder handshake,
+// mirroring how the dialer opens a fresh smux stream per Dial().
+func (c *Client) serveSmuxSession(log *xlog.Logger, session *smux.Session) {
+	defer func() { _ = session.Close() }() // nolint:errcheck
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if !c.isClosed() {
+				log.WithError(err).Infof("smux session ended")
+			}
+
+			return
+		}
 
-	c.log.Infof("Accepted connection from %v", remoteAddr)
+		go c.acceptStream(log, stream)
+	}
+}
+
+// acceptStream runs the directtransport responder handshake over one smux
+// stream and introduces the resulting conn to whichever Listener is bound
+// to the destination port the handshake negotiated.
+func (c *Client) acceptStream(log *xlog.Logger, stream *smux.Stream) {
+	log = log.With(map[string]interface{}{
+		"conv_id":         nextConvID(),
+		"handshake_stage": "responder-handshake",
+	})
 
 	var lis *directtransport.Listener
 
@@ -298,8 +517,8 @@ func (c *Client) acceptUDPConn() error {
 	})
 
 	connConfig := directtransport.ConnConfig{
-		Log:       c.log,
-		Conn:      udpConn,
+		Log:       log.Logger,
+		Conn:      stream,
 		LocalPK:   c.lPK,
 		LocalSK:   c.lSK,
 		Deadline:  time.Now().Add(directtransport.HandshakeTimeout),
@@ -311,10 +530,13 @@ func (c *Client) acceptUDPConn() error {
 
 	conn, err := directtransport.NewConn(connConfig)
 	if err != nil {
-		return err
+		log.WithError(err).Warnf("Failed directtransport handshake on stream")
+		return
 	}
 
-	return lis.Introduce(conn)
+	if err := lis.Introduce(conn); err != nil {
+		log.WithError(err).Warnf("Failed to introduce stream")
+	}
 }
 
 // Dial dials a new sudph.Conn to specified remote public key and port.
@@ -323,21 +545,29 @@ func (c *Client) Dial(ctx context.Context, rPK cipher.PubKey, rPort uint16) (*di
 		return nil, io.ErrClosedPipe
 	}
 
-	c.log.Infof("Dialing PK %v", rPK)
-
-	visorData, err := c.addressResolver.ResolveSUDPH(ctx, rPK)
-	if err != nil {
-		return nil, fmt.Errorf("resolve PK (holepunch): %w", err)
-	}
+	log := xlog.FromContext(ctx, c.log).With(map[string]interface{}{
+		"remote_pk":       rPK.String(),
+		"conv_id":         nextConvID(),
+		"handshake_stage": "resolve",
+	})
+	ctx = xlog.NewContext(ctx, log)
 
-	c.log.Infof("Resolved PK %v to visor data %v, dialing", rPK, visorData)
+	log.Infof("Dialing")
 
-	udpConn, err := c.dialVisor(visorData)
+	// openStream reuses a pooled session's multiplexed stream for rPK when
+	// one is live, and only resolves+hole-punches a fresh one otherwise.
+	udpConn, err := c.openStream(ctx, log, rPK)
 	if err != nil {
 		return nil, err
 	}
 
-	c.log.Infof("Dialed %v:%v@%v", rPK, rPort, udpConn.RemoteAddr())
+	log = log.With(map[string]interface{}{
+		"remote_addr":     udpConn.RemoteAddr().String(),
+		"remote_port":     rPort,
+		"handshake_stage": "kcp-setup",
+	})
+
+	log.Infof("Dialed")
 
 	lPort, freePort, err := c.p.ReserveEphemeral(ctx)
 	if err != nil {
@@ -347,7 +577,7 @@ func (c *Client) Dial(ctx context.Context, rPK cipher.PubKey, rPort uint16) (*di
 	hs := directtransport.InitiatorHandshake(c.lSK, dmsg.Addr{PK: c.lPK, Port: lPort}, dmsg.Addr{PK: rPK, Port: rPort})
 
 	connConfig := directtransport.ConnConfig{
-		Log:       c.log,
+		Log:       log.Logger,
 		Conn:      udpConn,
 		LocalPK:   c.lPK,
 		LocalSK:   c.lSK,
@@ -404,9 +634,15 @@ func (c *Client) Close() error {
 			c.log.WithError(err).Warnf("Failed to close address resolver client")
 		}
 
+		c.pool.closeAll()
+
 		for _, lis := range c.lMap {
 			_ = lis.Close() // nolint:errcheck
 		}
+
+		if c.dtlsListener != nil {
+			_ = c.dtlsListener.Close() // nolint:errcheck
+		}
 	})
 
 	return nil
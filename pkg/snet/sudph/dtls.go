@@ -0,0 +1,967 @@
+package sudph
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dmsgcipher "github.com/SkycoinProject/dmsg/cipher"
+)
+
+// DTLSMode selects how, or whether, a connection wraps its datagram flow in
+// a DTLS-lite association (see dtlsAssociation below).
+type DTLSMode int
+
+const (
+	// DTLSModeDisabled keeps the legacy hand-rolled Encrypt:true layer.
+	DTLSModeDisabled DTLSMode = iota
+
+	// DTLSModeOverKCP negotiates the association on top of the already
+	// reliable KCP stream ("DTLS over KCP": reliability first, encryption inside).
+	DTLSModeOverKCP
+
+	// DTLSModeUnderKCP encrypts the raw datagram flow first and runs KCP's
+	// reliability layer inside the association ("KCP over DTLS"). The
+	// dialing side gets a dedicated conn per peer (wrapDialPacketConn); the
+	// accepting side demultiplexes every peer's association state over the
+	// one shared listener socket instead (see dtlsListenerConn).
+	DTLSModeUnderKCP
+)
+
+// String implements fmt.Stringer.
+func (m DTLSMode) String() string {
+	switch m {
+	case DTLSModeOverKCP:
+		return "dtls-over-kcp"
+	case DTLSModeUnderKCP:
+		return "kcp-over-dtls"
+	default:
+		return "disabled"
+	}
+}
+
+// dtlsMaxFragment is the largest ciphertext payload a single on-wire record
+// may carry. On the datagram paths (dtlsPacketConn, dtlsListenerConn),
+// rather than fragment and reassemble oversized writes (more moving parts,
+// more ways to get reassembly wrong), writes over the limit are rejected
+// outright: kcp-go already keeps its own segments well under this, so in
+// practice the limit is never hit on the steady-state path. On the stream
+// path (dtlsConn), a larger write is split into records of at most this size.
+const dtlsMaxFragment = 1200
+
+const dtlsNonceSize = 12
+
+// dtlsReplayWindow is the width, in sequence numbers, of the sliding replay
+// window each direction tracks.
+const dtlsReplayWindow = 64
+
+// dtlsHandshakeTimeout bounds a single handshake attempt, so a speculative
+// candidate nobody is listening on (e.g. an unclaimed predicted port from
+// the port-prediction spray) fails fast instead of blocking its
+// connectivity-check goroutine, and therefore dialCandidates, forever.
+const dtlsHandshakeTimeout = 5 * time.Second
+
+// deadlineReadWriter is an io.ReadWriter that can also bound how long a Read
+// blocks. net.Conn already satisfies it, and packetConnReadWriter and
+// dtlsListenerPeerRW adapt a net.PacketConn to it; the
+// handshake helpers below take it instead of a bare io.ReadWriter so every
+// handshake, over any of the three transports this package wraps, is
+// deadline-bounded.
+type deadlineReadWriter interface {
+	io.ReadWriter
+	SetReadDeadline(time.Time) error
+}
+
+var (
+	// errDTLSHandshakeFailed means the confirmation step didn't match,
+	// i.e. the peer does not hold the private key behind its claimed
+	// (or expected) static identity.
+	errDTLSHandshakeFailed = errors.New("dtls: handshake confirmation failed, peer does not hold the expected identity key")
+	errDTLSReplayed        = errors.New("dtls: record rejected by replay window")
+)
+
+// dtlsAssociation is one DTLS-lite association: an ephemeral+static ECDH
+// handshake in the same spirit as Noise's IK pattern (the dialing side
+// already knows the peer's expected static key; the accepting side learns
+// and verifies it from the handshake itself), followed by an AEAD record
+// layer. It stands in for a real DTLS 1.2 handshake: sudph owns both ends of
+// every connection it wraps, and directtransport (which would otherwise be
+// the natural home for this) isn't part of this tree, so the association is
+// negotiated and enforced here instead, transparently, before the plain
+// net.Conn/net.PacketConn ever reaches directtransport.
+type dtlsAssociation struct {
+	sendKey [32]byte
+	recvKey [32]byte
+	sendSeq uint64
+
+	recvSeq    uint64
+	recvWindow replayWindow
+
+	peerPK dmsgcipher.PubKey
+}
+
+// replayWindow is a classic sliding-bitmap anti-replay window keyed by
+// monotonically increasing sequence numbers.
+type replayWindow struct {
+	highest uint64
+	mask    uint64
+	seen    bool
+}
+
+// accept reports whether seq is new, recording it if so. The first call
+// always accepts and seeds the window.
+func (w *replayWindow) accept(seq uint64) bool {
+	if !w.seen {
+		w.seen = true
+		w.highest = seq
+		w.mask = 1
+
+		return true
+	}
+
+	switch {
+	case seq > w.highest:
+		shift := seq - w.highest
+		if shift >= dtlsReplayWindow {
+			w.mask = 1
+		} else {
+			w.mask = (w.mask << shift) | 1
+		}
+
+		w.highest = seq
+
+		return true
+	case w.highest-seq >= dtlsReplayWindow:
+		return false
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.mask&bit != 0 {
+			return false
+		}
+
+		w.mask |= bit
+
+		return true
+	}
+}
+
+func writeLenPrefixed(w io.Writer, b []byte) error {
+	if len(b) > 255 {
+		return fmt.Errorf("dtls: value too large to frame (%d bytes)", len(b))
+	}
+
+	if _, err := w.Write([]byte{byte(len(b))}); err != nil {
+		return err
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+func readLenPrefixed(r io.Reader) ([]byte, error) {
+	var lenBuf [1]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, lenBuf[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// dtlsHandshakeInitiator performs the handshake as the dialing side, which
+// already knows the expected peer identity (rPK) ahead of time. deadline
+// bounds every read the handshake makes, so a candidate nobody answers on
+// fails fast instead of hanging its caller forever.
+func dtlsHandshakeInitiator(rw deadlineReadWriter, deadline time.Time, lSK dmsgcipher.SecKey, lPK dmsgcipher.PubKey, rPK dmsgcipher.PubKey) (*dtlsAssociation, error) {
+	if err := rw.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("dtls: set handshake deadline: %w", err)
+	}
+
+	ePK, eSK, err := dmsgcipher.GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("dtls: generate ephemeral keypair: %w", err)
+	}
+
+	if err := writeLenPrefixed(rw, ePK[:]); err != nil {
+		return nil, fmt.Errorf("dtls: send ephemeral key: %w", err)
+	}
+
+	if err := writeLenPrefixed(rw, lPK[:]); err != nil {
+		return nil, fmt.Errorf("dtls: send static key: %w", err)
+	}
+
+	peerEphemeral, err := readLenPrefixed(rw)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: read peer ephemeral key: %w", err)
+	}
+
+	peerEPK, err := dmsgcipher.NewPubKey(peerEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: malformed peer ephemeral key: %w", err)
+	}
+
+	dhEphemeral, err := dmsgcipher.ECDH(peerEPK, eSK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: ephemeral ECDH: %w", err)
+	}
+
+	// The static term is ECDH(expected peer static key, our own static key):
+	// only the real holder of rPK's secret key will derive the value the
+	// other side also derives, which is checked in confirm below.
+	dhStatic, err := dmsgcipher.ECDH(rPK, lSK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: static ECDH: %w", err)
+	}
+
+	assoc := newDTLSAssociation(dhEphemeral, dhStatic, ePK, peerEPK, true)
+	assoc.peerPK = rPK
+
+	if err := assoc.confirm(rw, true); err != nil {
+		return nil, err
+	}
+
+	return assoc, nil
+}
+
+// dtlsHandshakeResponder performs the handshake as the accepting side,
+// learning the dialing peer's claimed static identity from the handshake
+// itself; confirm trusts that claim only once it's proven the peer holds
+// the matching secret key. deadline bounds every read the handshake makes.
+func dtlsHandshakeResponder(rw deadlineReadWriter, deadline time.Time, lSK dmsgcipher.SecKey, lPK dmsgcipher.PubKey) (*dtlsAssociation, error) {
+	if err := rw.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("dtls: set handshake deadline: %w", err)
+	}
+
+	peerEphemeral, err := readLenPrefixed(rw)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: read peer ephemeral key: %w", err)
+	}
+
+	peerStatic, err := readLenPrefixed(rw)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: read peer static key: %w", err)
+	}
+
+	peerEPK, err := dmsgcipher.NewPubKey(peerEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: malformed peer ephemeral key: %w", err)
+	}
+
+	peerPK, err := dmsgcipher.NewPubKey(peerStatic)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: malformed peer static key: %w", err)
+	}
+
+	ePK, eSK, err := dmsgcipher.GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("dtls: generate ephemeral keypair: %w", err)
+	}
+
+	if err := writeLenPrefixed(rw, ePK[:]); err != nil {
+		return nil, fmt.Errorf("dtls: send ephemeral key: %w", err)
+	}
+
+	dhEphemeral, err := dmsgcipher.ECDH(peerEPK, eSK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: ephemeral ECDH: %w", err)
+	}
+
+	dhStatic, err := dmsgcipher.ECDH(peerPK, lSK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: static ECDH: %w", err)
+	}
+
+	assoc := newDTLSAssociation(dhEphemeral, dhStatic, peerEPK, ePK, false)
+	assoc.peerPK = peerPK
+
+	if err := assoc.confirm(rw, false); err != nil {
+		return nil, err
+	}
+
+	return assoc, nil
+}
+
+// newDTLSAssociation derives the two directional AEAD keys from the
+// handshake's ECDH outputs. Keys are labelled by initiator/responder role
+// (not send/recv) so both sides derive identical bytes from identical
+// inputs; initiatorEPK/responderEPK must be passed in that fixed order by
+// both callers so the transcript hash matches on each side.
+func newDTLSAssociation(dhEphemeral, dhStatic []byte, initiatorEPK, responderEPK dmsgcipher.PubKey, initiator bool) *dtlsAssociation {
+	transcript := sha256.New()
+	transcript.Write(dhEphemeral)
+	transcript.Write(dhStatic)
+	transcript.Write(initiatorEPK[:])
+	transcript.Write(responderEPK[:])
+	seed := transcript.Sum(nil)
+
+	i2r := hkdfExpand(seed, []byte("sudph-dtls initiator-to-responder"))
+	r2i := hkdfExpand(seed, []byte("sudph-dtls responder-to-initiator"))
+
+	assoc := &dtlsAssociation{}
+	if initiator {
+		assoc.sendKey, assoc.recvKey = i2r, r2i
+	} else {
+		assoc.sendKey, assoc.recvKey = r2i, i2r
+	}
+
+	return assoc
+}
+
+// hkdfExpand is a minimal single-block HMAC-based expand, sufficient here
+// since the input secret is already a high-entropy ECDH transcript hash.
+func hkdfExpand(secret, label []byte) [32]byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(label)
+	mac.Write([]byte{0x01})
+
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+
+	return out
+}
+
+// confirmTag is order-independent (sendKey XOR recvKey is the same for
+// both roles) so both sides can compute and compare it before they've
+// settled on which slot is "send" from the other's point of view.
+func (a *dtlsAssociation) confirmTag() [32]byte {
+	var combined [32]byte
+	for i := range combined {
+		combined[i] = a.sendKey[i] ^ a.recvKey[i]
+	}
+
+	return sha256.Sum256(append([]byte("sudph-dtls confirm"), combined[:]...))
+}
+
+// confirm exchanges a confirmation tag proving each side derived the same
+// shared secret, i.e. that the static ECDH term matched and the peer really
+// holds the private key behind its claimed (or expected) identity.
+func (a *dtlsAssociation) confirm(rw io.ReadWriter, initiator bool) error {
+	tag := a.confirmTag()
+
+	if initiator {
+		if err := writeLenPrefixed(rw, tag[:]); err != nil {
+			return fmt.Errorf("dtls: send confirmation: %w", err)
+		}
+	}
+
+	peerTag, err := readLenPrefixed(rw)
+	if err != nil {
+		return fmt.Errorf("dtls: read confirmation: %w", err)
+	}
+
+	if !hmac.Equal(peerTag, tag[:]) {
+		return errDTLSHandshakeFailed
+	}
+
+	if !initiator {
+		if err := writeLenPrefixed(rw, tag[:]); err != nil {
+			return fmt.Errorf("dtls: send confirmation: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func newAEAD(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// packetConnReadWriter adapts a net.PacketConn fixed to a single remote
+// address into a deadlineReadWriter, so the handshake helpers above (written
+// once against deadlineReadWriter) work for both the stream (post-KCP) and
+// datagram (pre-KCP) wrapping paths.
+type packetConnReadWriter struct {
+	pc    net.PacketConn
+	raddr net.Addr
+}
+
+func (rw *packetConnReadWriter) Write(p []byte) (int, error) {
+	return rw.pc.WriteTo(p, rw.raddr)
+}
+
+func (rw *packetConnReadWriter) Read(p []byte) (int, error) {
+	n, _, err := rw.pc.ReadFrom(p)
+	return n, err
+}
+
+func (rw *packetConnReadWriter) SetReadDeadline(t time.Time) error {
+	return rw.pc.SetReadDeadline(t)
+}
+
+// dtlsConn wraps a reliable, ordered net.Conn (post-KCP) with the
+// association's AEAD record layer.
+type dtlsConn struct {
+	net.Conn
+
+	assoc    *dtlsAssociation
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+
+	readBuf []byte
+}
+
+func wrapDTLSConn(conn net.Conn, assoc *dtlsAssociation) (net.Conn, error) {
+	sendAEAD, err := newAEAD(assoc.sendKey)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: init send cipher: %w", err)
+	}
+
+	recvAEAD, err := newAEAD(assoc.recvKey)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: init recv cipher: %w", err)
+	}
+
+	return &dtlsConn{Conn: conn, assoc: assoc, sendAEAD: sendAEAD, recvAEAD: recvAEAD}, nil
+}
+
+func (d *dtlsConn) Write(p []byte) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > dtlsMaxFragment {
+			chunk = chunk[:dtlsMaxFragment]
+		}
+
+		if err := d.writeRecord(chunk); err != nil {
+			return total, err
+		}
+
+		total += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return total, nil
+}
+
+func (d *dtlsConn) writeRecord(p []byte) error {
+	seq := atomic.AddUint64(&d.assoc.sendSeq, 1) - 1
+
+	var nonce [dtlsNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	ct := d.sendAEAD.Seal(nil, nonce[:], p, nil)
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(ct)))
+
+	if _, err := d.Conn.Write(lenBuf[:]); err != nil {
+		return err
+	}
+
+	_, err := d.Conn.Write(ct)
+
+	return err
+}
+
+func (d *dtlsConn) Read(p []byte) (int, error) {
+	for len(d.readBuf) == 0 {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(d.Conn, lenBuf[:]); err != nil {
+			return 0, err
+		}
+
+		ct := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(d.Conn, ct); err != nil {
+			return 0, err
+		}
+
+		seq := d.assoc.recvSeq
+
+		var nonce [dtlsNonceSize]byte
+		binary.BigEndian.PutUint64(nonce[4:], seq)
+
+		pt, err := d.recvAEAD.Open(nil, nonce[:], ct, nil)
+		if err != nil {
+			return 0, fmt.Errorf("dtls: record authentication failed: %w", err)
+		}
+
+		if !d.assoc.recvWindow.accept(seq) {
+			return 0, errDTLSReplayed
+		}
+
+		d.assoc.recvSeq++
+		d.readBuf = pt
+	}
+
+	n := copy(p, d.readBuf)
+	d.readBuf = d.readBuf[n:]
+
+	return n, nil
+}
+
+// dtlsPacketConn wraps a raw, unreliable net.PacketConn (pre-KCP) with the
+// association's AEAD record layer. Unlike dtlsConn it has no read buffering
+// to do across calls: KCP expects one logical packet back per ReadFrom.
+type dtlsPacketConn struct {
+	net.PacketConn
+
+	assoc    *dtlsAssociation
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+}
+
+func (d *dtlsPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > dtlsMaxFragment {
+		return 0, fmt.Errorf("dtls: record of %d bytes exceeds the %d-byte PMTU-safe limit", len(p), dtlsMaxFragment)
+	}
+
+	seq := atomic.AddUint64(&d.assoc.sendSeq, 1) - 1
+
+	var nonce [dtlsNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	ct := d.sendAEAD.Seal(nil, nonce[:], p, nil)
+
+	buf := make([]byte, 8+len(ct))
+	binary.BigEndian.PutUint64(buf[:8], seq)
+	copy(buf[8:], ct)
+
+	if _, err := d.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (d *dtlsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, dtlsMaxFragment+8+32)
+
+	for {
+		n, addr, err := d.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		if n < 8 {
+			continue // too short to carry a sequence number, drop
+		}
+
+		seq := binary.BigEndian.Uint64(buf[:8])
+
+		var nonce [dtlsNonceSize]byte
+		binary.BigEndian.PutUint64(nonce[4:], seq)
+
+		pt, err := d.recvAEAD.Open(nil, nonce[:], buf[8:n], nil)
+		if err != nil {
+			continue // unauthenticated or corrupt datagram, drop
+		}
+
+		if !d.assoc.recvWindow.accept(seq) {
+			continue // replay, drop
+		}
+
+		return copy(p, pt), addr, nil
+	}
+}
+
+// wrapInitiatorConn wraps conn in a DTLS-lite association when dtlsMode is
+// DTLSModeOverKCP, leaving conn untouched otherwise. Called once KCP's
+// reliability layer already sits underneath, so the record layer can assume
+// ordered, lossless delivery.
+func (c *Client) wrapInitiatorConn(conn net.Conn, rPK cipher.PubKey) (net.Conn, error) {
+	if c.dtlsMode != DTLSModeOverKCP {
+		return conn, nil
+	}
+
+	assoc, err := dtlsHandshakeInitiator(conn, time.Now().Add(dtlsHandshakeTimeout), c.lSK, c.lPK, rPK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls handshake (%v, initiator): %w", c.dtlsMode, err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("dtls: clear handshake deadline: %w", err)
+	}
+
+	return wrapDTLSConn(conn, assoc)
+}
+
+// wrapResponderConn resolves the peer identity of an accepted conn, wrapping
+// it in a DTLS-lite association first when dtlsMode is DTLSModeOverKCP. For
+// DTLSModeUnderKCP the association was already negotiated beneath KCP, on
+// the shared listener socket, before KCP ever produced this conn (see
+// dtlsListenerConn), so here the peer identity is simply looked up by the
+// conn's remote address.
+func (c *Client) wrapResponderConn(conn net.Conn) (net.Conn, cipher.PubKey, error) {
+	switch c.dtlsMode {
+	case DTLSModeOverKCP:
+		assoc, err := dtlsHandshakeResponder(conn, time.Now().Add(dtlsHandshakeTimeout), c.lSK, c.lPK)
+		if err != nil {
+			return nil, cipher.PubKey{}, fmt.Errorf("dtls handshake (%v, responder): %w", c.dtlsMode, err)
+		}
+
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, cipher.PubKey{}, fmt.Errorf("dtls: clear handshake deadline: %w", err)
+		}
+
+		wrapped, err := wrapDTLSConn(conn, assoc)
+		if err != nil {
+			return nil, cipher.PubKey{}, err
+		}
+
+		return wrapped, assoc.peerPK, nil
+
+	case DTLSModeUnderKCP:
+		peerPK, ok := c.dtlsListener.peerPK(conn.RemoteAddr())
+		if !ok {
+			return nil, cipher.PubKey{}, fmt.Errorf("dtls: no negotiated association for %v", conn.RemoteAddr())
+		}
+
+		return conn, peerPK, nil
+
+	default:
+		return conn, cipher.PubKey{}, nil
+	}
+}
+
+// wrapDialPacketConn wraps pc in a DTLS-lite association when dtlsMode is
+// DTLSModeUnderKCP, so KCP's own reliability layer runs on top of an
+// already encrypted and authenticated datagram flow. This is the dialing
+// side: pc here is a dedicated, per-peer pfilter conn, unlike the shared
+// listener socket the accept path demultiplexes many peers over, which
+// keeps per-remote association state in dtlsListenerConn instead.
+func (c *Client) wrapDialPacketConn(pc net.PacketConn, rAddr net.Addr, rPK cipher.PubKey) (net.PacketConn, error) {
+	if c.dtlsMode != DTLSModeUnderKCP {
+		return pc, nil
+	}
+
+	rw := &packetConnReadWriter{pc: pc, raddr: rAddr}
+
+	assoc, err := dtlsHandshakeInitiator(rw, time.Now().Add(dtlsHandshakeTimeout), c.lSK, c.lPK, rPK)
+	if err != nil {
+		return nil, fmt.Errorf("dtls handshake (%v, initiator): %w", c.dtlsMode, err)
+	}
+
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("dtls: clear handshake deadline: %w", err)
+	}
+
+	sendAEAD, err := newAEAD(assoc.sendKey)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: init send cipher: %w", err)
+	}
+
+	recvAEAD, err := newAEAD(assoc.recvKey)
+	if err != nil {
+		return nil, fmt.Errorf("dtls: init recv cipher: %w", err)
+	}
+
+	return &dtlsPacketConn{PacketConn: pc, assoc: assoc, sendAEAD: sendAEAD, recvAEAD: recvAEAD}, nil
+}
+
+// dtlsListenerPacket is one datagram pulled off a dtlsListenerConn's shared
+// socket by its pump goroutine, destined either for an established session's
+// readCh or for the in-progress handshake waiting on that remote address.
+type dtlsListenerPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// dtlsListenerSession is one peer's established DTLSModeUnderKCP association
+// on a dtlsListenerConn, once its responder handshake has completed.
+type dtlsListenerSession struct {
+	assoc    *dtlsAssociation
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+}
+
+// dtlsListenerPeerRW adapts one pending handshake's inbound packets into a
+// deadlineReadWriter, so dtlsHandshakeResponder (written once against that
+// interface) can run against a single remote address multiplexed out of a
+// shared listener socket, the same as it runs against a dedicated conn.
+type dtlsListenerPeerRW struct {
+	listener *dtlsListenerConn
+	addr     net.Addr
+	in       chan []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+	pending  []byte
+}
+
+func (rw *dtlsListenerPeerRW) Write(p []byte) (int, error) {
+	return rw.listener.pc.WriteTo(p, rw.addr)
+}
+
+func (rw *dtlsListenerPeerRW) SetReadDeadline(t time.Time) error {
+	rw.mu.Lock()
+	rw.deadline = t
+	rw.mu.Unlock()
+
+	return nil
+}
+
+func (rw *dtlsListenerPeerRW) Read(p []byte) (int, error) {
+	rw.mu.Lock()
+	deadline := rw.deadline
+	rw.mu.Unlock()
+
+	if len(rw.pending) > 0 {
+		n := copy(p, rw.pending)
+		rw.pending = rw.pending[n:]
+
+		return n, nil
+	}
+
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case buf, ok := <-rw.in:
+		if !ok {
+			return 0, io.ErrClosedPipe
+		}
+
+		n := copy(p, buf)
+		rw.pending = buf[n:]
+
+		return n, nil
+	case <-timeout:
+		return 0, fmt.Errorf("dtls: handshake read from %v: %w", rw.addr, os.ErrDeadlineExceeded)
+	case <-rw.listener.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// dtlsListenerConn wraps the shared listener socket so DTLSModeUnderKCP also
+// works on the accepting side: unlike the dialing side, which gets a
+// dedicated pfilter conn per peer (wrapDialPacketConn), every peer's
+// association here is demultiplexed, by remote address, off one socket.
+type dtlsListenerConn struct {
+	pc  net.PacketConn
+	lSK dmsgcipher.SecKey
+	lPK dmsgcipher.PubKey
+
+	mu      sync.Mutex
+	assocs  map[string]*dtlsListenerSession
+	pending map[string]*dtlsListenerPeerRW
+
+	readCh chan dtlsListenerPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+// wrapListenerPacketConn starts demultiplexing pc's inbound datagrams by
+// remote address, so kcp.ServeConn can read/write an encrypted, authenticated
+// stream per peer while pc itself stays free for unwrapped uses (e.g. raw
+// hole-punch probes) elsewhere in Client.
+func wrapListenerPacketConn(pc net.PacketConn, lSK dmsgcipher.SecKey, lPK dmsgcipher.PubKey) *dtlsListenerConn {
+	l := &dtlsListenerConn{
+		pc:      pc,
+		lSK:     lSK,
+		lPK:     lPK,
+		assocs:  make(map[string]*dtlsListenerSession),
+		pending: make(map[string]*dtlsListenerPeerRW),
+		readCh:  make(chan dtlsListenerPacket),
+		closed:  make(chan struct{}),
+	}
+
+	go l.pump()
+
+	return l
+}
+
+// pump is the sole reader of the shared listener socket while DTLSModeUnderKCP
+// is active: it demultiplexes every inbound datagram to the peer's pending
+// handshake, decrypts it for an already-established session, or starts a new
+// responder handshake for an address seen for the first time.
+func (l *dtlsListenerConn) pump() {
+	buf := make([]byte, dtlsMaxFragment+8+32)
+
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			close(l.closed)
+			return
+		}
+
+		if n < 8 {
+			continue // too short to carry a sequence number, drop
+		}
+
+		packet := append([]byte(nil), buf[:n]...)
+
+		l.mu.Lock()
+
+		if sess, ok := l.assocs[addr.String()]; ok {
+			l.mu.Unlock()
+			l.deliver(sess, addr, packet)
+
+			continue
+		}
+
+		if rw, ok := l.pending[addr.String()]; ok {
+			l.mu.Unlock()
+
+			select {
+			case rw.in <- packet:
+			case <-l.closed:
+			}
+
+			continue
+		}
+
+		l.mu.Unlock()
+		l.startHandshake(addr, packet)
+	}
+}
+
+func (l *dtlsListenerConn) deliver(sess *dtlsListenerSession, addr net.Addr, packet []byte) {
+	seq := binary.BigEndian.Uint64(packet[:8])
+
+	var nonce [dtlsNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	pt, err := sess.recvAEAD.Open(nil, nonce[:], packet[8:], nil)
+	if err != nil {
+		return // unauthenticated or corrupt datagram, drop
+	}
+
+	if !sess.assoc.recvWindow.accept(seq) {
+		return // replay, drop
+	}
+
+	select {
+	case l.readCh <- dtlsListenerPacket{data: pt, addr: addr}:
+	case <-l.closed:
+	}
+}
+
+// startHandshake runs a responder handshake against addr in its own
+// goroutine, feeding it first (the datagram that triggered this call) as its
+// initial read before handing further reads off to pump via rw.in.
+func (l *dtlsListenerConn) startHandshake(addr net.Addr, first []byte) {
+	rw := &dtlsListenerPeerRW{listener: l, addr: addr, in: make(chan []byte, 4), pending: first}
+
+	l.mu.Lock()
+	l.pending[addr.String()] = rw
+	l.mu.Unlock()
+
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			delete(l.pending, addr.String())
+			l.mu.Unlock()
+		}()
+
+		assoc, err := dtlsHandshakeResponder(rw, time.Now().Add(dtlsHandshakeTimeout), l.lSK, l.lPK)
+		if err != nil {
+			return
+		}
+
+		sendAEAD, err := newAEAD(assoc.sendKey)
+		if err != nil {
+			return
+		}
+
+		recvAEAD, err := newAEAD(assoc.recvKey)
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+		l.assocs[addr.String()] = &dtlsListenerSession{assoc: assoc, sendAEAD: sendAEAD, recvAEAD: recvAEAD}
+		l.mu.Unlock()
+	}()
+}
+
+// peerPK reports the peer identity negotiated for addr, once its responder
+// handshake has completed.
+func (l *dtlsListenerConn) peerPK(addr net.Addr) (cipher.PubKey, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sess, ok := l.assocs[addr.String()]
+	if !ok {
+		return cipher.PubKey{}, false
+	}
+
+	return sess.assoc.peerPK, true
+}
+
+// ReadFrom blocks for the next decrypted datagram from any peer with an
+// established association, the plaintext read loop kcp.ServeConn drives.
+func (l *dtlsListenerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-l.readCh:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-l.closed:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+// WriteTo encrypts and sends p to addr under addr's established association.
+func (l *dtlsListenerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > dtlsMaxFragment {
+		return 0, fmt.Errorf("dtls: record of %d bytes exceeds the %d-byte PMTU-safe limit", len(p), dtlsMaxFragment)
+	}
+
+	l.mu.Lock()
+	sess, ok := l.assocs[addr.String()]
+	l.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("dtls: no negotiated association for %v", addr)
+	}
+
+	seq := atomic.AddUint64(&sess.assoc.sendSeq, 1) - 1
+
+	var nonce [dtlsNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	ct := sess.sendAEAD.Seal(nil, nonce[:], p, nil)
+
+	buf := make([]byte, 8+len(ct))
+	binary.BigEndian.PutUint64(buf[:8], seq)
+	copy(buf[8:], ct)
+
+	if _, err := l.pc.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close stops demultiplexing. It does not close the underlying pc, which
+// Client owns and also uses unwrapped (e.g. for raw hole-punch probes).
+func (l *dtlsListenerConn) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// LocalAddr satisfies net.PacketConn by delegating to the underlying socket.
+func (l *dtlsListenerConn) LocalAddr() net.Addr { return l.pc.LocalAddr() }
+
+// SetDeadline, SetReadDeadline and SetWriteDeadline are no-ops: each
+// responder handshake startHandshake runs already applies its own deadline
+// through dtlsListenerPeerRW, and kcp-go does not rely on
+// the listener conn's own deadlines once an association is established.
+func (l *dtlsListenerConn) SetDeadline(time.Time) error      { return nil }
+func (l *dtlsListenerConn) SetReadDeadline(time.Time) error  { return nil }
+func (l *dtlsListenerConn) SetWriteDeadline(time.Time) error { return nil }
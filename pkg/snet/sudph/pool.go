@@ -0,0 +1,239 @@
+package sudph
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/xtaci/smux"
+
+	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/xlog"
+)
+
+// PoolConfig tunes Client's connection pool for repeated Dials to the same peer.
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle peer sessions kept open at once.
+	MaxIdle int
+	// IdleTimeout closes a pooled session that hasn't been used for this long.
+	IdleTimeout time.Duration
+	// KeepaliveInterval is how often a pooled session pings its peer to keep
+	// the underlying NAT mapping alive.
+	KeepaliveInterval time.Duration
+}
+
+// DefaultPoolConfig is used when WithPoolConfig is not given to NewClient.
+var DefaultPoolConfig = PoolConfig{
+	MaxIdle:           8,
+	IdleTimeout:       5 * time.Minute,
+	KeepaliveInterval: 15 * time.Second,
+}
+
+// PoolStats reports dialPool usage.
+type PoolStats struct {
+	OpenSessions int
+	OpenStreams  int
+}
+
+// pooledSession is a live smux session multiplexed over one hole-punched,
+// KCP-reliable link to a peer, shared by repeated Dials to that peer.
+type pooledSession struct {
+	session  *smux.Session
+	lastUsed time.Time
+}
+
+// pendingDial tracks a dial already in flight for a peer, so concurrent
+// callers join it instead of each hole-punching and dialing their own
+// session.
+type pendingDial struct {
+	done    chan struct{}
+	session *smux.Session
+	err     error
+}
+
+// dialPool keeps established smux sessions open across repeated Dials to
+// the same peer, only hole-punching again once no live session remains,
+// and coalesces concurrent dials to a peer with none yet established.
+type dialPool struct {
+	conf PoolConfig
+
+	mu       sync.Mutex
+	sessions map[cipher.PubKey]*pooledSession
+	pending  map[cipher.PubKey]*pendingDial
+}
+
+func newDialPool(conf PoolConfig) *dialPool {
+	return &dialPool{
+		conf:     conf,
+		sessions: make(map[cipher.PubKey]*pooledSession),
+		pending:  make(map[cipher.PubKey]*pendingDial),
+	}
+}
+
+// get returns the live session for rPK, evicting it first if it has closed
+// or gone idle past IdleTimeout.
+func (p *dialPool) get(rPK cipher.PubKey) (*smux.Session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.getLocked(rPK)
+}
+
+func (p *dialPool) getLocked(rPK cipher.PubKey) (*smux.Session, bool) {
+	sess, ok := p.sessions[rPK]
+	if !ok {
+		return nil, false
+	}
+
+	if sess.session.IsClosed() || (p.conf.IdleTimeout > 0 && time.Since(sess.lastUsed) > p.conf.IdleTimeout) {
+		_ = sess.session.Close() // nolint:errcheck
+		delete(p.sessions, rPK)
+
+		return nil, false
+	}
+
+	sess.lastUsed = time.Now()
+
+	return sess.session, true
+}
+
+// put stores a newly established session for rPK, closing whatever session
+// was already stored for rPK (if any), then evicting the oldest session
+// first if doing so would exceed MaxIdle.
+func (p *dialPool) put(rPK cipher.PubKey, session *smux.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.sessions[rPK]; ok {
+		_ = old.session.Close() // nolint:errcheck
+	}
+
+	if p.conf.MaxIdle > 0 && len(p.sessions) >= p.conf.MaxIdle {
+		if _, ok := p.sessions[rPK]; !ok {
+			var oldestPK cipher.PubKey
+
+			var oldest time.Time
+
+			for pk, sess := range p.sessions {
+				if oldest.IsZero() || sess.lastUsed.Before(oldest) {
+					oldestPK, oldest = pk, sess.lastUsed
+				}
+			}
+
+			if old, ok := p.sessions[oldestPK]; ok {
+				_ = old.session.Close() // nolint:errcheck
+				delete(p.sessions, oldestPK)
+			}
+		}
+	}
+
+	p.sessions[rPK] = &pooledSession{session: session, lastUsed: time.Now()}
+}
+
+// dial returns the live session for rPK, joining an in-flight dial for rPK
+// if one is already running, or running newSession itself and publishing
+// the result to any callers that join while it's in flight.
+func (p *dialPool) dial(rPK cipher.PubKey, newSession func() (*smux.Session, error)) (*smux.Session, error) {
+	p.mu.Lock()
+
+	if sess, ok := p.getLocked(rPK); ok {
+		p.mu.Unlock()
+		return sess, nil
+	}
+
+	if pd, ok := p.pending[rPK]; ok {
+		p.mu.Unlock()
+		<-pd.done
+
+		return pd.session, pd.err
+	}
+
+	pd := &pendingDial{done: make(chan struct{})}
+	p.pending[rPK] = pd
+	p.mu.Unlock()
+
+	pd.session, pd.err = newSession()
+
+	if pd.err == nil {
+		p.put(rPK, pd.session)
+	}
+
+	p.mu.Lock()
+	delete(p.pending, rPK)
+	p.mu.Unlock()
+
+	close(pd.done)
+
+	return pd.session, pd.err
+}
+
+// stats reports current pool usage.
+func (p *dialPool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PoolStats{OpenSessions: len(p.sessions)}
+
+	for _, sess := range p.sessions {
+		stats.OpenStreams += sess.session.NumStreams()
+	}
+
+	return stats
+}
+
+// closeAll closes every pooled session. Called from Client.Close.
+func (p *dialPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for rPK, sess := range p.sessions {
+		_ = sess.session.Close() // nolint:errcheck
+		delete(p.sessions, rPK)
+	}
+}
+
+// openStream returns a stream multiplexed over a pooled session to rPK,
+// hole-punching and establishing a fresh session only when none is live,
+// and joining an already in-flight dial to rPK rather than duplicating it.
+func (c *Client) openStream(ctx context.Context, log *xlog.Logger, rPK cipher.PubKey) (net.Conn, error) {
+	if session, ok := c.pool.get(rPK); ok {
+		stream, err := session.OpenStream()
+		if err == nil {
+			log.Infof("Reused pooled session")
+			return stream, nil
+		}
+
+		log.WithError(err).Warnf("Pooled session is unusable, dialing fresh")
+	}
+
+	session, err := c.pool.dial(rPK, func() (*smux.Session, error) {
+		visorData, err := c.addressResolver.ResolveSUDPH(ctx, rPK)
+		if err != nil {
+			return nil, fmt.Errorf("resolve PK (holepunch): %w", err)
+		}
+
+		log.WithField("visor_data", visorData).Infof("Resolved PK, dialing")
+
+		udpConn, err := c.dialVisor(ctx, rPK, visorData)
+		if err != nil {
+			return nil, err
+		}
+
+		smuxConf := smux.DefaultConfig()
+		smuxConf.KeepAliveInterval = c.poolConf.KeepaliveInterval
+
+		session, err := smux.Client(udpConn, smuxConf)
+		if err != nil {
+			return nil, fmt.Errorf("smux.Client: %w", err)
+		}
+
+		return session, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return session.OpenStream()
+}
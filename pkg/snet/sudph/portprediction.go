@@ -0,0 +1,178 @@
+package sudph
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/xlog"
+)
+
+// HolePunchStrategy selects which extra techniques Client uses while hole punching.
+type HolePunchStrategy int
+
+const (
+	// HolePunchStrategyDefault only tries the candidates reported by the
+	// address resolver (host, server-reflexive).
+	HolePunchStrategyDefault HolePunchStrategy = iota
+	// HolePunchStrategyPortPrediction additionally sprays a window of
+	// predicted ports around a peer's last observed external port, to punch
+	// through incrementing-port symmetric NATs. This only does anything once
+	// a caller supplies WithPortPredictionHintProvider (and, to measure a
+	// delta to report in the first place, WithPortProbeResolver and
+	// WithPortPredictionReporter); nothing in this tree implements them yet,
+	// so selecting this strategy alone is a no-op.
+	HolePunchStrategyPortPrediction
+)
+
+// portPredictionWindow is how far on either side of a predicted port Client
+// sprays HolePunchMessage packets.
+const portPredictionWindow = 16
+
+// portProbeResolver exposes two well-known probe ports for symmetric-NAT
+// port-delta measurement. portPredictionReporter lets Client attach the
+// delta/lastPort pair it measured to its BindSUDPH registration, so peers
+// resolving us later get a prediction hint. portPredictionHintProvider lets
+// Client ask for a peer's previously reported delta/lastPort pair.
+//
+// See the Option doc comment for why these are supplied via
+// WithPortProbeResolver, WithPortPredictionReporter and
+// WithPortPredictionHintProvider instead of being asserted against
+// addressResolver: HolePunchStrategyPortPrediction only does anything once a
+// caller actually wires up a resolver that implements them.
+type (
+	portProbeResolver interface {
+		ProbeUDPAddrs() (addrA, addrB string, ok bool)
+	}
+
+	portPredictionReporter interface {
+		ReportPortPrediction(delta, lastPort int)
+	}
+
+	portPredictionHintProvider interface {
+		PortPredictionHint(pk cipher.PubKey) (delta, lastPort int, ok bool)
+	}
+)
+
+// WithPortProbeResolver supplies the probe endpoints probeSymmetricNATPorts
+// needs. Without it, HolePunchStrategyPortPrediction never measures a delta.
+func WithPortProbeResolver(r portProbeResolver) Option {
+	return func(c *Client) {
+		c.probeResolver = r
+	}
+}
+
+// WithPortPredictionReporter supplies where Serve reports a measured
+// delta/lastPort pair once it's gathered one.
+func WithPortPredictionReporter(r portPredictionReporter) Option {
+	return func(c *Client) {
+		c.predictionReporter = r
+	}
+}
+
+// WithPortPredictionHintProvider supplies where predictedCandidates looks up
+// a peer's previously reported delta/lastPort pair. Without it,
+// HolePunchStrategyPortPrediction never produces predicted candidates.
+func WithPortPredictionHintProvider(p portPredictionHintProvider) Option {
+	return func(c *Client) {
+		c.predictionHints = p
+	}
+}
+
+// probeSymmetricNATPorts sends two probes to the configured probe resolver's
+// well-known probe ports and records the sequence of external ports it
+// observed, returning the delta between them and the most recent port.
+func (c *Client) probeSymmetricNATPorts(ctx context.Context) (delta, lastPort int, ok bool) {
+	if c.probeResolver == nil {
+		return 0, 0, false
+	}
+
+	log := xlog.FromContext(ctx, c.log)
+
+	addrA, addrB, ok := c.probeResolver.ProbeUDPAddrs()
+	if !ok {
+		return 0, 0, false
+	}
+
+	portA, err := c.sendPortProbe(addrA)
+	if err != nil {
+		log.WithError(err).WithField("probe_addr", addrA).Infof("Port-prediction probe failed")
+		return 0, 0, false
+	}
+
+	portB, err := c.sendPortProbe(addrB)
+	if err != nil {
+		log.WithError(err).WithField("probe_addr", addrB).Infof("Port-prediction probe failed")
+		return 0, 0, false
+	}
+
+	return portB - portA, portB, true
+}
+
+// sendPortProbe sends a single hole-punch probe to addr over its own
+// ephemeral socket and returns the external port the address resolver
+// reports having observed the probe arrive from.
+func (c *Client) sendPortProbe(addr string) (int, error) {
+	rAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+
+	probeConn := c.packetFilter.NewConn(30, nil)
+	defer func() { _ = probeConn.Close() }() // nolint:errcheck
+
+	if _, err := probeConn.WriteTo([]byte(HolePunchMessage), rAddr); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 32)
+
+	n, _, err := probeConn.ReadFrom(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(buf[:n]))
+}
+
+// predictedCandidates sprays a window of ports around a peer's predicted
+// next external port, built from the delta/lastPort hint
+// c.predictionHints reported for rPK.
+func (c *Client) predictedCandidates(rPK cipher.PubKey, remoteAddr string) []Candidate {
+	if c.holePunchStrategy != HolePunchStrategyPortPrediction {
+		return nil
+	}
+
+	if c.predictionHints == nil {
+		return nil
+	}
+
+	delta, lastPort, ok := c.predictionHints.PortPredictionHint(rPK)
+	if !ok {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	predicted := lastPort + delta
+
+	var candidates []Candidate
+
+	for p := predicted - portPredictionWindow; p <= predicted+portPredictionWindow; p++ {
+		if p <= 0 || p > 65535 {
+			continue
+		}
+
+		candidates = append(candidates, Candidate{
+			Type: CandidatePredicted,
+			Addr: net.JoinHostPort(host, strconv.Itoa(p)),
+		})
+	}
+
+	return candidates
+}
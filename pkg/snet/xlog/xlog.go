@@ -0,0 +1,59 @@
+// Package xlog adds context-propagating, field-based logging on top of
+// github.com/SkycoinProject/skycoin/src/util/logging, so a connection's
+// lifecycle can be filtered and correlated in aggregated logs instead of
+// grepping formatted strings.
+package xlog
+
+import (
+	"context"
+
+	"github.com/SkycoinProject/skycoin/src/util/logging"
+)
+
+type ctxKey struct{}
+
+// Logger wraps *logging.Logger, enriching every line with a stable set of
+// key/value fields carried alongside it.
+type Logger struct {
+	*logging.Logger
+	fields map[string]interface{}
+}
+
+// New wraps log with no fields set.
+func New(log *logging.Logger) *Logger {
+	return &Logger{Logger: log}
+}
+
+// With returns a copy of l with fields merged in, so downstream log lines
+// carry them without repeating them at every call site.
+func (l *Logger) With(fields map[string]interface{}) *Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+
+	log := l.Logger
+
+	for k, v := range fields {
+		merged[k] = v
+		log = log.WithField(k, v)
+	}
+
+	return &Logger{Logger: log, fields: merged}
+}
+
+// NewContext returns a copy of ctx carrying log, retrievable with FromContext.
+func NewContext(ctx context.Context, log *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, log)
+}
+
+// FromContext returns the Logger stored in ctx, or New(fallback) if ctx
+// carries none.
+func FromContext(ctx context.Context, fallback *logging.Logger) *Logger {
+	if log, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return log
+	}
+
+	return New(fallback)
+}
@@ -0,0 +1,37 @@
+package visitor
+
+import "time"
+
+const (
+	backoffMin    = 500 * time.Millisecond
+	backoffMax    = 30 * time.Second
+	backoffFactor = 2
+)
+
+// backoff is a minimal exponential backoff used while reconnecting a Visitor
+// tunnel after a failed dial.
+type backoff struct {
+	next time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{next: backoffMin}
+}
+
+// current returns the delay the next wait() will use.
+func (b *backoff) current() time.Duration {
+	return b.next
+}
+
+// wait returns a channel that fires after the current backoff delay, then
+// advances the delay toward backoffMax.
+func (b *backoff) wait() <-chan time.Time {
+	d := b.next
+
+	b.next *= backoffFactor
+	if b.next > backoffMax {
+		b.next = backoffMax
+	}
+
+	return time.After(d)
+}
@@ -0,0 +1,188 @@
+package visitor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// udpSessionIdleTimeout evicts a UDP session that hasn't forwarded a
+// datagram in either direction for this long, so a client that vanishes
+// without sending a final datagram doesn't leak its tunnel forever.
+const udpSessionIdleTimeout = 2 * time.Minute
+
+// udpFrameMaxLen is the largest datagram writeUDPFrame can carry, matching
+// the maximum size of a UDP payload.
+const udpFrameMaxLen = 65507
+
+// udpSession is one local-source-address's tunnel: datagrams read from
+// srcAddr on the local listener are framed and written to remote, and
+// frames read back from remote are written back to srcAddr.
+type udpSession struct {
+	srcAddr   net.Addr
+	remote    io.ReadWriteCloser
+	idleTimer *time.Timer
+}
+
+// writeUDPFrame writes b to w prefixed with a 2-byte length, so datagram
+// boundaries survive being carried over sudph's reliable, stream-oriented
+// tunnel.
+func writeUDPFrame(w io.Writer, b []byte) error {
+	if len(b) > udpFrameMaxLen {
+		return fmt.Errorf("visitor: udp datagram too large to frame (%d bytes)", len(b))
+	}
+
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(b)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+// readUDPFrame reads one writeUDPFrame-framed datagram from r.
+func readUDPFrame(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (v *Visitor) startUDP() error {
+	bindAddr := v.bindAddr()
+
+	pc, err := net.ListenPacket("udp", bindAddr)
+	if err != nil {
+		return fmt.Errorf("listen on %v: %w", bindAddr, err)
+	}
+
+	v.packetConn = pc
+	v.udpSessions = make(map[string]*udpSession)
+
+	v.log.WithField("local_pk", v.localPK).
+		Infof("Visitor listening on %v, tunneling to %v:%v", bindAddr, v.conf.ServerPK, v.conf.ServerPort)
+
+	buf := make([]byte, udpFrameMaxLen)
+
+	for {
+		n, srcAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-v.done:
+				return nil
+			default:
+				return fmt.Errorf("read: %w", err)
+			}
+		}
+
+		payload := append([]byte(nil), buf[:n]...)
+
+		v.forwardUDPDatagram(srcAddr, payload)
+	}
+}
+
+// forwardUDPDatagram hands payload off to srcAddr's udpSession, dialing a
+// fresh one first if this is the first datagram seen from srcAddr.
+func (v *Visitor) forwardUDPDatagram(srcAddr net.Addr, payload []byte) {
+	sess, err := v.udpSessionFor(srcAddr)
+	if err != nil {
+		v.log.WithError(err).Warnf("Failed to tunnel UDP datagram from %v", srcAddr)
+		return
+	}
+
+	if err := writeUDPFrame(sess.remote, payload); err != nil {
+		v.log.WithError(err).Warnf("Failed to forward UDP datagram from %v, dropping session", srcAddr)
+		v.closeUDPSession(srcAddr.String(), sess)
+
+		return
+	}
+
+	sess.idleTimer.Reset(udpSessionIdleTimeout)
+}
+
+func (v *Visitor) udpSessionFor(srcAddr net.Addr) (*udpSession, error) {
+	key := srcAddr.String()
+
+	v.udpMu.Lock()
+	sess, ok := v.udpSessions[key]
+	v.udpMu.Unlock()
+
+	if ok {
+		return sess, nil
+	}
+
+	remote, err := v.dialWithBackoff()
+	if err != nil {
+		return nil, err
+	}
+
+	sess = &udpSession{srcAddr: srcAddr, remote: remote}
+	sess.idleTimer = time.AfterFunc(udpSessionIdleTimeout, func() {
+		v.log.Infof("UDP session for %v went idle, closing", srcAddr)
+		v.closeUDPSession(key, sess)
+	})
+
+	v.udpMu.Lock()
+	v.udpSessions[key] = sess
+	v.udpMu.Unlock()
+
+	atomic.AddInt32(&v.activeTunnels, 1)
+
+	v.wg.Add(1)
+
+	go v.pumpUDPSession(key, sess)
+
+	return sess, nil
+}
+
+// pumpUDPSession reads frames off sess.remote and writes each one back to
+// sess.srcAddr on the local listener, until the remote side closes, the
+// session goes idle past udpSessionIdleTimeout, or the Visitor is closed.
+func (v *Visitor) pumpUDPSession(key string, sess *udpSession) {
+	defer v.wg.Done()
+	defer atomic.AddInt32(&v.activeTunnels, -1)
+	defer v.closeUDPSession(key, sess)
+
+	for {
+		frame, err := readUDPFrame(sess.remote)
+		if err != nil {
+			if err != io.EOF {
+				v.log.WithError(err).Infof("UDP session for %v ended", sess.srcAddr)
+			}
+
+			return
+		}
+
+		sess.idleTimer.Reset(udpSessionIdleTimeout)
+
+		if _, err := v.packetConn.WriteTo(frame, sess.srcAddr); err != nil {
+			v.log.WithError(err).Warnf("Failed to deliver UDP datagram to %v", sess.srcAddr)
+			return
+		}
+	}
+}
+
+func (v *Visitor) closeUDPSession(key string, sess *udpSession) {
+	v.udpMu.Lock()
+	if v.udpSessions[key] == sess {
+		delete(v.udpSessions, key)
+	}
+	v.udpMu.Unlock()
+
+	sess.idleTimer.Stop()
+	_ = sess.remote.Close() // nolint:errcheck
+}
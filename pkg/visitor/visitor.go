@@ -0,0 +1,279 @@
+// Package visitor lets a user configure a local TCP/UDP listener that
+// transparently tunnels to a named remote peer over sudph, the way frp's
+// client visitors expose a local service through a remote frps.
+package visitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/skycoin/src/util/logging"
+
+	"github.com/SkycoinProject/skywire-mainnet/pkg/snet/sudph"
+)
+
+// Type selects which local transport a Visitor listens on.
+type Type string
+
+const (
+	// TypeSTCP tunnels a local TCP listener.
+	TypeSTCP Type = "stcp"
+	// TypeSUDP tunnels a local UDP listener.
+	TypeSUDP Type = "sudp"
+)
+
+// Config describes a single local-port-to-remote-peer tunnel: connections
+// accepted on BindAddr:BindPort are piped to ServerPK:ServerPort.
+type Config struct {
+	Type       Type
+	ServerPK   cipher.PubKey
+	ServerPort uint16
+	BindAddr   string
+	BindPort   uint16
+	// SK identifies this tunnel to the operator independently of whatever
+	// identity the shared sudph.Client dials out as; it never signs or
+	// authenticates anything on the wire. It's surfaced as LocalPK in
+	// Status so a box running several Visitors can tell them apart in
+	// logs/metrics.
+	SK cipher.SecKey
+}
+
+// Status reports a Visitor's configuration and current load, for operators
+// polling several Visitors sharing one process.
+type Status struct {
+	Type          Type
+	BindAddr      string
+	ServerPK      cipher.PubKey
+	ServerPort    uint16
+	LocalPK       cipher.PubKey
+	ActiveTunnels int
+}
+
+// Visitor accepts local connections and tunnels each through sudph to the
+// peer and port described by its Config.
+type Visitor struct {
+	log     *logging.Logger
+	conf    Config
+	client  *sudph.Client
+	localPK cipher.PubKey
+
+	listener   net.Listener
+	packetConn net.PacketConn
+
+	udpMu       sync.Mutex
+	udpSessions map[string]*udpSession
+
+	tcpMu    sync.Mutex
+	tcpConns map[net.Conn]struct{}
+
+	activeTunnels int32
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// NewVisitor creates a Visitor that tunnels through client.
+func NewVisitor(conf Config, client *sudph.Client) *Visitor {
+	return &Visitor{
+		log:    logging.MustGetLogger(fmt.Sprintf("visitor:%s:%d", conf.Type, conf.BindPort)),
+		conf:   conf,
+		client: client,
+		done:   make(chan struct{}),
+	}
+}
+
+// Status reports the Visitor's configuration and current tunnel count.
+func (v *Visitor) Status() Status {
+	return Status{
+		Type:          v.conf.Type,
+		BindAddr:      net.JoinHostPort(v.conf.BindAddr, fmt.Sprintf("%d", v.conf.BindPort)),
+		ServerPK:      v.conf.ServerPK,
+		ServerPort:    v.conf.ServerPort,
+		LocalPK:       v.localPK,
+		ActiveTunnels: int(atomic.LoadInt32(&v.activeTunnels)),
+	}
+}
+
+// Start begins accepting local connections and tunneling them. It blocks
+// until the Visitor is closed or the listener fails.
+func (v *Visitor) Start() error {
+	localPK, err := v.conf.SK.PubKey()
+	if err != nil {
+		return fmt.Errorf("visitor: invalid SK: %w", err)
+	}
+
+	v.localPK = localPK
+
+	switch v.conf.Type {
+	case TypeSTCP:
+		return v.startTCP()
+	case TypeSUDP:
+		return v.startUDP()
+	default:
+		return fmt.Errorf("visitor: unsupported type %q", v.conf.Type)
+	}
+}
+
+func (v *Visitor) bindAddr() string {
+	return net.JoinHostPort(v.conf.BindAddr, fmt.Sprintf("%d", v.conf.BindPort))
+}
+
+func (v *Visitor) startTCP() error {
+	bindAddr := v.bindAddr()
+
+	lis, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return fmt.Errorf("listen on %v: %w", bindAddr, err)
+	}
+
+	v.listener = lis
+	v.tcpConns = make(map[net.Conn]struct{})
+
+	v.log.WithField("local_pk", v.localPK).
+		Infof("Visitor listening on %v, tunneling to %v:%v", bindAddr, v.conf.ServerPK, v.conf.ServerPort)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-v.done:
+				return nil
+			default:
+				return fmt.Errorf("accept: %w", err)
+			}
+		}
+
+		v.wg.Add(1)
+
+		go v.serveConn(conn)
+	}
+}
+
+func (v *Visitor) serveConn(local net.Conn) {
+	defer v.wg.Done()
+	defer func() { _ = local.Close() }() // nolint:errcheck
+
+	v.tcpMu.Lock()
+	v.tcpConns[local] = struct{}{}
+	v.tcpMu.Unlock()
+
+	defer func() {
+		v.tcpMu.Lock()
+		delete(v.tcpConns, local)
+		v.tcpMu.Unlock()
+	}()
+
+	remote, err := v.dialWithBackoff()
+	if err != nil {
+		v.log.WithError(err).Errorf("Failed to dial %v:%v for local conn from %v",
+			v.conf.ServerPK, v.conf.ServerPort, local.RemoteAddr())
+		return
+	}
+
+	defer func() { _ = remote.Close() }() // nolint:errcheck
+
+	atomic.AddInt32(&v.activeTunnels, 1)
+	defer atomic.AddInt32(&v.activeTunnels, -1)
+
+	v.log.Infof("Tunneling %v <-> %v:%v", local.RemoteAddr(), v.conf.ServerPK, v.conf.ServerPort)
+
+	pipe(local, remote)
+}
+
+// dialWithBackoff dials the Visitor's remote peer, retrying with backoff
+// until it succeeds or the Visitor is closed.
+func (v *Visitor) dialWithBackoff() (io.ReadWriteCloser, error) {
+	b := newBackoff()
+
+	for {
+		conn, err := v.client.Dial(context.Background(), v.conf.ServerPK, v.conf.ServerPort)
+		if err == nil {
+			return conn, nil
+		}
+
+		v.log.WithError(err).Infof("Reconnect attempt failed, retrying in %v", b.current())
+
+		select {
+		case <-v.done:
+			return nil, errors.New("visitor: closed while reconnecting")
+		case <-b.wait():
+		}
+	}
+}
+
+// pipe copies data in both directions until either side closes.
+func pipe(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b) // nolint:errcheck
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a) // nolint:errcheck
+	}()
+
+	wg.Wait()
+}
+
+// Close stops the Visitor, closing its listener and waiting for in-flight
+// tunnels to finish.
+func (v *Visitor) Close() error {
+	if v == nil {
+		return nil
+	}
+
+	v.once.Do(func() {
+		close(v.done)
+
+		if v.listener != nil {
+			_ = v.listener.Close() // nolint:errcheck
+		}
+
+		if v.packetConn != nil {
+			_ = v.packetConn.Close() // nolint:errcheck
+		}
+
+		v.udpMu.Lock()
+		sessions := make([]*udpSession, 0, len(v.udpSessions))
+		for _, sess := range v.udpSessions {
+			sessions = append(sessions, sess)
+		}
+		v.udpMu.Unlock()
+
+		for _, sess := range sessions {
+			sess.idleTimer.Stop()
+			_ = sess.remote.Close() // nolint:errcheck
+		}
+
+		// Force-close live TCP tunnels too: serveConn's pipe() otherwise
+		// blocks on io.Copy until a peer closes its side, which would hang
+		// wg.Wait() below forever for a tunnel that's still in use (e.g. an
+		// open SSH session).
+		v.tcpMu.Lock()
+		conns := make([]net.Conn, 0, len(v.tcpConns))
+		for conn := range v.tcpConns {
+			conns = append(conns, conn)
+		}
+		v.tcpMu.Unlock()
+
+		for _, conn := range conns {
+			_ = conn.Close() // nolint:errcheck
+		}
+	})
+
+	v.wg.Wait()
+
+	return nil
+}